@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	flow "github.com/bwNetFlow/protobuf/go"
+)
+
+func newTestBatchConnector(batchSize int, maxWait time.Duration) *Connector {
+	return &Connector{
+		batchSize:            batchSize,
+		batchMaxWait:         maxWait,
+		consumerChannel:      make(chan *flow.FlowMessage),
+		consumerBatchChannel: make(chan []*flow.FlowMessage, 1),
+	}
+}
+
+func TestBatchFlowsFlushesAtSize(t *testing.T) {
+	connector := newTestBatchConnector(2, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go connector.batchFlows(ctx)
+
+	a, b := new(flow.FlowMessage), new(flow.FlowMessage)
+	connector.consumerChannel <- a
+	connector.consumerChannel <- b
+
+	select {
+	case batch := <-connector.consumerBatchChannel:
+		if len(batch) != 2 || batch[0] != a || batch[1] != b {
+			t.Fatalf("batch = %v, want [a b]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for size-triggered flush")
+	}
+}
+
+func TestBatchFlowsFlushesAtMaxWait(t *testing.T) {
+	connector := newTestBatchConnector(10, 20*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go connector.batchFlows(ctx)
+
+	msg := new(flow.FlowMessage)
+	connector.consumerChannel <- msg
+
+	select {
+	case batch := <-connector.consumerBatchChannel:
+		if len(batch) != 1 || batch[0] != msg {
+			t.Fatalf("batch = %v, want [msg]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for maxWait-triggered flush")
+	}
+}
+
+func TestBatchFlowsFlushesRemainderOnClose(t *testing.T) {
+	connector := newTestBatchConnector(10, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go connector.batchFlows(ctx)
+
+	msg := new(flow.FlowMessage)
+	connector.consumerChannel <- msg
+	close(connector.consumerChannel)
+
+	select {
+	case batch, ok := <-connector.consumerBatchChannel:
+		if !ok {
+			t.Fatal("consumerBatchChannel closed before final flush")
+		}
+		if len(batch) != 1 || batch[0] != msg {
+			t.Fatalf("batch = %v, want [msg]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for close-triggered flush")
+	}
+
+	select {
+	case _, ok := <-connector.consumerBatchChannel:
+		if ok {
+			t.Fatal("expected consumerBatchChannel to close after final flush")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for consumerBatchChannel to close")
+	}
+}
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	flow "github.com/bwNetFlow/protobuf/go"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Codec converts FlowMessages to and from the bytes stored on a Kafka
+// topic, so a Connector's topics need not speak protobuf directly. The
+// default, used when SetCodec is never called, is ProtobufCodec.
+type Codec interface {
+	Encode(*flow.FlowMessage) ([]byte, error)
+	Decode([]byte) (*flow.FlowMessage, error)
+}
+
+// SetCodec overrides the wire format used by StartConsumer to decode
+// messages and by StartProducer to encode them. Call this before
+// StartConsumer/StartProducer.
+func (connector *Connector) SetCodec(codec Codec) {
+	connector.codec = codec
+}
+
+// ProtobufCodec is the default Codec, matching the wire format bwNetFlow
+// topics have always used.
+type ProtobufCodec struct{}
+
+// Encode implements Codec.
+func (ProtobufCodec) Encode(msg *flow.FlowMessage) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+// Decode implements Codec.
+func (ProtobufCodec) Decode(data []byte) (*flow.FlowMessage, error) {
+	flowMsg := new(flow.FlowMessage)
+	if err := proto.Unmarshal(data, flowMsg); err != nil {
+		return nil, err
+	}
+	return flowMsg, nil
+}
+
+// JSONCodec encodes/decodes FlowMessages as protobuf-JSON
+// (https://protobuf.dev/programming-guides/json/), for interoperability
+// with non-Go or non-protobuf producers/consumers on the same topic.
+type JSONCodec struct{}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(msg *flow.FlowMessage) ([]byte, error) {
+	return protojson.Marshal(msg)
+}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(data []byte) (*flow.FlowMessage, error) {
+	flowMsg := new(flow.FlowMessage)
+	if err := protojson.Unmarshal(data, flowMsg); err != nil {
+		return nil, err
+	}
+	return flowMsg, nil
+}
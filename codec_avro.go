@@ -0,0 +1,181 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	flow "github.com/bwNetFlow/protobuf/go"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// confluentMagicByte is the leading byte of Confluent's Schema-Registry wire
+// format: magic byte, 4-byte big-endian schema ID, Avro binary payload.
+const confluentMagicByte = 0x0
+
+// AvroCodec is a Codec that speaks Confluent's Schema-Registry wire format,
+// so a FlowMessage topic can interoperate with non-bwNetFlow consumers and
+// producers built around Avro. FlowMessages are bridged to/from Avro's
+// native representation via protobuf-JSON, so the Avro schema's field names
+// must match the FlowMessage protobuf's JSON field names.
+type AvroCodec struct {
+	registry *schemaRegistryClient
+	schemaID int
+	codec    *goavro.Codec
+}
+
+// NewAvroCodec registers schema under subject with the Schema Registry at
+// registryURL and returns a Codec that encodes FlowMessages against that
+// schema. Decode resolves whichever schema ID a message's wire bytes carry,
+// fetching and caching schemas it hasn't seen yet, so it also accepts
+// messages written under older versions of the schema.
+func NewAvroCodec(registryURL, subject, schema string) (*AvroCodec, error) {
+	client := newSchemaRegistryClient(registryURL)
+	id, codec, err := client.registerSchema(subject, schema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroCodec{registry: client, schemaID: id, codec: codec}, nil
+}
+
+// Encode implements Codec.
+func (a *AvroCodec) Encode(msg *flow.FlowMessage) ([]byte, error) {
+	jsonBytes, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := a.codec.NativeFromTextual(jsonBytes)
+	if err != nil {
+		return nil, fmt.Errorf("avro: message does not match configured schema: %w", err)
+	}
+	avroBytes, err := a.codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 5, 5+len(avroBytes))
+	out[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(out[1:5], uint32(a.schemaID))
+	return append(out, avroBytes...), nil
+}
+
+// Decode implements Codec.
+func (a *AvroCodec) Decode(data []byte) (*flow.FlowMessage, error) {
+	if len(data) < 5 || data[0] != confluentMagicByte {
+		return nil, errors.New("avro: message is missing the Confluent wire format magic byte")
+	}
+	id := int(binary.BigEndian.Uint32(data[1:5]))
+	codec, err := a.registry.codecForID(id)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := codec.NativeFromBinary(data[5:])
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	flowMsg := new(flow.FlowMessage)
+	if err := protojson.Unmarshal(jsonBytes, flowMsg); err != nil {
+		return nil, err
+	}
+	return flowMsg, nil
+}
+
+// schemaRegistryClient is a minimal Confluent Schema Registry client,
+// caching resolved Avro codecs by schema ID.
+type schemaRegistryClient struct {
+	baseURL string
+	http    *http.Client
+
+	mu    sync.Mutex
+	cache map[int]*goavro.Codec
+}
+
+func newSchemaRegistryClient(baseURL string) *schemaRegistryClient {
+	return &schemaRegistryClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: 10 * time.Second},
+		cache:   make(map[int]*goavro.Codec),
+	}
+}
+
+// codecForID returns the Avro codec for schema ID, fetching and caching it
+// from the registry if this is the first time it's been seen.
+func (c *schemaRegistryClient) codecForID(id int) (*goavro.Codec, error) {
+	c.mu.Lock()
+	codec, ok := c.cache[id]
+	c.mu.Unlock()
+	if ok {
+		return codec, nil
+	}
+
+	resp, err := c.http.Get(fmt.Sprintf("%s/schemas/ids/%d", c.baseURL, id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry: GET /schemas/ids/%d: %s", id, resp.Status)
+	}
+	var parsed struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+	codec, err = goavro.NewCodec(parsed.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[id] = codec
+	c.mu.Unlock()
+	return codec, nil
+}
+
+// registerSchema registers schema under subject with the registry, caching
+// the resulting codec under its assigned ID for later Decode calls.
+func (c *schemaRegistryClient) registerSchema(subject, schema string) (int, *goavro.Codec, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	body, err := json.Marshal(struct {
+		Schema string `json:"schema"`
+	}{Schema: schema})
+	if err != nil {
+		return 0, nil, err
+	}
+	url := fmt.Sprintf("%s/subjects/%s/versions", c.baseURL, subject)
+	resp, err := c.http.Post(url, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, nil, fmt.Errorf("schema registry: POST /subjects/%s/versions: %s", subject, resp.Status)
+	}
+	var parsed struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return 0, nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[parsed.ID] = codec
+	c.mu.Unlock()
+	return parsed.ID, codec, nil
+}
@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	flow "github.com/bwNetFlow/protobuf/go"
+)
+
+func TestProtobufCodecRoundTrip(t *testing.T) {
+	codec := ProtobufCodec{}
+	msg := new(flow.FlowMessage)
+
+	data, err := codec.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := codec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	gotData, err := codec.Encode(got)
+	if err != nil {
+		t.Fatalf("re-Encode: %v", err)
+	}
+	if !bytes.Equal(data, gotData) {
+		t.Fatalf("round trip mismatch: got %x, want %x", gotData, data)
+	}
+}
+
+func TestJSONCodecRoundTrip(t *testing.T) {
+	codec := JSONCodec{}
+	msg := new(flow.FlowMessage)
+
+	data, err := codec.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := codec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	gotData, err := codec.Encode(got)
+	if err != nil {
+		t.Fatalf("re-Encode: %v", err)
+	}
+	if !bytes.Equal(data, gotData) {
+		t.Fatalf("round trip mismatch: got %s, want %s", gotData, data)
+	}
+}
+
+// fieldlessAvroSchema is a valid Avro record with no fields, so it can
+// round-trip a FlowMessage's JSON bridge representation without depending
+// on the actual (externally-defined) FlowMessage field set.
+const fieldlessAvroSchema = `{"type":"record","name":"Empty","fields":[]}`
+
+func newTestSchemaRegistry(t *testing.T, id int, schema string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/subjects/flows/versions":
+			json.NewEncoder(w).Encode(struct {
+				ID int `json:"id"`
+			}{ID: id})
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/1":
+			json.NewEncoder(w).Encode(struct {
+				Schema string `json:"schema"`
+			}{Schema: schema})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestAvroCodecRoundTripAndFraming(t *testing.T) {
+	srv := newTestSchemaRegistry(t, 1, fieldlessAvroSchema)
+	defer srv.Close()
+
+	codec, err := NewAvroCodec(srv.URL, "flows", fieldlessAvroSchema)
+	if err != nil {
+		t.Fatalf("NewAvroCodec: %v", err)
+	}
+
+	msg := new(flow.FlowMessage)
+	data, err := codec.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	if len(data) < 5 {
+		t.Fatalf("encoded message too short for Confluent framing: %d bytes", len(data))
+	}
+	if data[0] != confluentMagicByte {
+		t.Fatalf("magic byte = %#x, want %#x", data[0], confluentMagicByte)
+	}
+	if id := binary.BigEndian.Uint32(data[1:5]); id != 1 {
+		t.Fatalf("schema ID = %d, want 1", id)
+	}
+
+	got, err := codec.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	gotData, err := codec.Encode(got)
+	if err != nil {
+		t.Fatalf("re-Encode: %v", err)
+	}
+	if !bytes.Equal(data, gotData) {
+		t.Fatalf("round trip mismatch: got %x, want %x", gotData, data)
+	}
+}
+
+func TestAvroCodecDecodeRejectsMissingMagicByte(t *testing.T) {
+	codec := &AvroCodec{}
+	if _, err := codec.Decode([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error for message missing the Confluent magic byte")
+	}
+}
@@ -1,29 +1,52 @@
 package kafka
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Shopify/sarama"
-	cluster "github.com/bsm/sarama-cluster"
-	flow "omi-gitlab.e-technik.uni-ulm.de/bwnetflow/bwnetflow_api/go"
+	flow "github.com/bwNetFlow/protobuf/go"
+	gometrics "github.com/rcrowley/go-metrics"
 )
 
 // Connector handles a connection to read bwNetFlow flows from kafka.
 type Connector struct {
-	user            string
-	pass            string
-	consumer        *cluster.Consumer
-	producer        sarama.AsyncProducer
-	consumerChannel chan *flow.FlowMessage
-	producerChannel chan *flow.FlowMessage
-	manualErrFlag   bool
-	manualErrSignal chan bool
-	channelLength   uint
+	user                 string
+	pass                 string
+	saslMechanism        sarama.SASLMechanism
+	tokenProvider        sarama.AccessTokenProvider
+	tlsConfig            *tls.Config
+	consumerGroup        sarama.ConsumerGroup
+	consumerCancel       context.CancelFunc
+	onAssign             func([]TopicPartition)
+	onRevoke             func([]TopicPartition)
+	notifications        chan *Notification
+	exactlyOnce          bool
+	transactionalID      string
+	batchSize            int
+	batchMaxWait         time.Duration
+	consumerBatchChannel chan []*flow.FlowMessage
+	parallelDecoders     int
+	decodeJobs           chan decodeJob
+	metrics              *metrics
+	saramaRegistry       gometrics.Registry
+	metricsClient        sarama.Client
+	metricsLagInterval   time.Duration
+	producer             sarama.AsyncProducer
+	consumerChannel      chan *flow.FlowMessage
+	producerChannel      chan *flow.FlowMessage
+	manualErrFlag        bool
+	manualErrSignal      chan bool
+	channelLength        uint
+	codec                Codec
 }
 
 // Explicitly set which login to use in SASL/PLAIN auth via TLS
@@ -32,7 +55,8 @@ func (connector *Connector) SetAuth(user string, pass string) {
 	connector.pass = pass
 }
 
-// Check environment to infer which login to use in SASL/PLAIN auth via TLS
+// Check environment to infer which login to use in SASL/PLAIN auth via TLS,
+// and optionally load a custom CA bundle from KAFKA_SSL_CA_FILE.
 // Requires KAFKA_SASL_USER and KAFKA_SASL_PASS to be set for this process.
 func (connector *Connector) SetAuthFromEnv() error {
 	connector.user = os.Getenv("KAFKA_SASL_USER")
@@ -40,6 +64,11 @@ func (connector *Connector) SetAuthFromEnv() error {
 	if connector.user == "" || connector.pass == "" {
 		return errors.New("Setting Kafka SASL info from Environment was unsuccessful.")
 	}
+	if caFile := os.Getenv("KAFKA_SSL_CA_FILE"); caFile != "" {
+		if err := connector.SetTLSConfigFromCAFile(caFile); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -49,6 +78,84 @@ func (connector *Connector) SetAuthAnon() {
 	connector.pass = "anon"
 }
 
+// SetTLSConfig overrides the TLS configuration used by both StartConsumer
+// and StartProducer, e.g. to load a private CA bundle or a client
+// certificate for mTLS-only deployments. If this is never called, a config
+// trusting just the system cert pool is used instead.
+func (connector *Connector) SetTLSConfig(config *tls.Config) {
+	connector.tlsConfig = config
+}
+
+// SetTLSConfigFromCAFile builds a TLS config trusting the system cert pool
+// plus the PEM-encoded CA bundle found at path, and installs it via
+// SetTLSConfig. This is the programmatic equivalent of the KAFKA_SSL_CA_FILE
+// environment variable read by SetAuthFromEnv.
+func (connector *Connector) SetTLSConfigFromCAFile(path string) error {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !rootCAs.AppendCertsFromPEM(pemBytes) {
+		return fmt.Errorf("SetTLSConfigFromCAFile: no certificates found in %s", path)
+	}
+	connector.tlsConfig = &tls.Config{RootCAs: rootCAs}
+	return nil
+}
+
+// SetSASL configures the SASL mechanism used for authentication, replacing
+// the SASL/PLAIN default. Supported mechanisms are
+// sarama.SASLTypePlaintext, SASLTypeSCRAMSHA256, SASLTypeSCRAMSHA512 and
+// SASLTypeOAuth, the last of which requires a non-nil tokenProvider.
+// Pass an empty mechanism with empty user/pass to disable SASL entirely and
+// rely on mTLS alone, as required by some managed Kafka offerings.
+func (connector *Connector) SetSASL(mechanism sarama.SASLMechanism, user string, pass string, tokenProvider sarama.AccessTokenProvider) {
+	connector.saslMechanism = mechanism
+	connector.user = user
+	connector.pass = pass
+	connector.tokenProvider = tokenProvider
+}
+
+// SetRebalanceCallbacks registers callbacks invoked from the consumer
+// group's Setup/Cleanup phases: onAssign right after partitions have been
+// assigned to this instance, onRevoke right before they are revoked for a
+// rebalance. Either may be nil. Call this before StartConsumer.
+func (connector *Connector) SetRebalanceCallbacks(onAssign, onRevoke func([]TopicPartition)) {
+	connector.onAssign = onAssign
+	connector.onRevoke = onRevoke
+}
+
+// EnableExactlyOnce configures the producer for exactly-once semantics
+// using Kafka transactions (idempotent production, a single in-flight
+// request and RequiredAcks=WaitForAll under transactionalID), and sets the
+// consumer's isolation level so it only observes committed transactions.
+// Call this before StartProducer/StartConsumer. Use BeginTxn/CommitTxn/
+// AbortTxn and SendOffsetsToTxn to drive the transaction itself.
+func (connector *Connector) EnableExactlyOnce(transactionalID string) {
+	connector.exactlyOnce = true
+	connector.transactionalID = transactionalID
+}
+
+// SetConsumerBatch switches ConsumerChannel delivery to the batching mode
+// exposed via ConsumerBatchChannel: batches of up to size FlowMessages,
+// flushed early after maxWait so a slow trickle of flows doesn't stall
+// downstream consumers. Call this before StartConsumer.
+func (connector *Connector) SetConsumerBatch(size int, maxWait time.Duration) {
+	connector.batchSize = size
+	connector.batchMaxWait = maxWait
+}
+
+// SetParallelDecoders runs the Codec's Decode of consumed messages across n
+// worker goroutines shared across all claimed partitions, since
+// decoding is the hot path for high-volume flow topics. n<=1
+// keeps decoding inline within ConsumeClaim. Call this before StartConsumer.
+func (connector *Connector) SetParallelDecoders(n int) {
+	connector.parallelDecoders = n
+}
+
 // Enable manual error handling by setting the internal flags.
 // Any application calling this will have to read all messages provided by the
 // channels returned from the ConsumerErrors, ConsumerNotifications and
@@ -70,59 +177,247 @@ func (connector *Connector) SetChannelLength(l uint) {
 	connector.channelLength = l
 }
 
+// buildTLSConfig returns the TLS config set via SetTLSConfig/
+// SetTLSConfigFromCAFile, falling back to the system cert pool.
+func (connector *Connector) buildTLSConfig() (*tls.Config, error) {
+	if connector.tlsConfig != nil {
+		return connector.tlsConfig, nil
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{RootCAs: rootCAs}, nil
+}
+
+// configureSASL applies the mechanism set via SetSASL to conf. Without a
+// mechanism, it falls back to SASL/PLAIN for backwards compatibility if
+// credentials were set via SetAuth/SetAuthFromEnv/SetAuthAnon, or leaves
+// SASL disabled entirely for mTLS-only deployments.
+func (connector *Connector) configureSASL(conf *sarama.Config) error {
+	if connector.saslMechanism == "" && connector.user == "" && connector.pass == "" && connector.tokenProvider == nil {
+		return nil
+	}
+
+	mechanism := connector.saslMechanism
+	if mechanism == "" {
+		mechanism = sarama.SASLTypePlaintext
+	}
+
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Mechanism = mechanism
+	conf.Net.SASL.User = connector.user
+	conf.Net.SASL.Password = connector.pass
+
+	switch mechanism {
+	case sarama.SASLTypePlaintext:
+		// user/pass above is sufficient
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &XDGSCRAMClient{HashGeneratorFcn: SHA256} }
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &XDGSCRAMClient{HashGeneratorFcn: SHA512} }
+	case sarama.SASLTypeOAuth:
+		if connector.tokenProvider == nil {
+			return errors.New("configureSASL: SASL/OAUTHBEARER requires a tokenProvider, see SetSASL")
+		}
+		conf.Net.SASL.TokenProvider = connector.tokenProvider
+	default:
+		return fmt.Errorf("configureSASL: unsupported SASL mechanism %q", mechanism)
+	}
+	return nil
+}
+
+// saslDescription returns a short human-readable label for the configured
+// SASL mechanism, used for logging on connect. It reports "mTLS only, no
+// SASL" if SASL is disabled entirely.
+func (connector *Connector) saslDescription() string {
+	if connector.saslMechanism == "" && connector.user == "" && connector.pass == "" && connector.tokenProvider == nil {
+		return "mTLS only, no SASL"
+	}
+	if connector.saslMechanism == "" {
+		return "SASL/PLAIN"
+	}
+	return "SASL/" + string(connector.saslMechanism)
+}
+
 // Start a Kafka Consumer with the specified parameters. Its output will be
-// available in the channel returned by ConsumerChannel.
+// available in the channel returned by ConsumerChannel. The consume loop
+// runs until CloseConsumer/Close is called, which cancels the context
+// driving it.
 func (connector *Connector) StartConsumer(broker string, topics []string, consumergroup string, offset int64) error {
-	var err error
 	if !connector.manualErrFlag && connector.manualErrSignal == nil {
 		connector.manualErrSignal = make(chan bool)
 	}
 	brokers := strings.Split(broker, ",")
-	consConf := cluster.NewConfig()
+	consConf := sarama.NewConfig()
 	// Enable TLS
-	rootCAs, err := x509.SystemCertPool()
+	tlsConfig, err := connector.buildTLSConfig()
 	if err != nil {
 		log.Println("TLS Error:", err)
 		return err
 	}
 	consConf.Net.TLS.Enable = true
-	consConf.Net.TLS.Config = &tls.Config{RootCAs: rootCAs}
+	consConf.Net.TLS.Config = tlsConfig
 
-	consConf.Net.SASL.Enable = true
-	consConf.Net.SASL.User = connector.user
-	consConf.Net.SASL.Password = connector.pass
+	if err := connector.configureSASL(consConf); err != nil {
+		return err
+	}
 
 	// Enable these unconditionally.
 	consConf.Consumer.Return.Errors = true
-	consConf.Group.Return.Notifications = true
 	// The offset only works initially. When reusing a Consumer Group, it's
 	// last state will be resumed automatcally (grep MarkOffset)
 	consConf.Consumer.Offsets.Initial = offset
+	if connector.exactlyOnce {
+		// Only observe transactions that have been committed upstream.
+		consConf.Consumer.IsolationLevel = sarama.ReadCommitted
+		// Offsets must only advance atomically with the producer
+		// transaction they were consumed into, via SendOffsetsToTxn. An
+		// independent auto-commit here could advance the group's offset
+		// past a transaction that later aborts, losing those flows.
+		consConf.Consumer.Offsets.AutoCommit.Enable = false
+	}
+	if connector.saramaRegistry != nil {
+		consConf.MetricRegistry = connector.saramaRegistry
+	}
 
 	// everything declared and configured, lets go
-	log.Printf("Trying to connect to Kafka as SASL/PLAIN user '%s'...", consConf.Net.SASL.User)
-	connector.consumer, err = cluster.NewConsumer(brokers, consumergroup, topics, consConf)
+	log.Printf("Trying to connect to Kafka as user '%s' using %s...", consConf.Net.SASL.User, connector.saslDescription())
+	connector.consumerGroup, err = sarama.NewConsumerGroup(brokers, consumergroup, consConf)
 	if err != nil {
 		return err
 	}
 	log.Println("Kafka TLS connection established.")
 
+	if connector.metrics != nil {
+		// Only used to read brokers' high water marks for lag computation;
+		// the committed offset side comes from this consumer's own
+		// MarkMessage calls (see offsetTracker), not a second OffsetManager
+		// for the same group.
+		if connector.metricsClient, err = sarama.NewClient(brokers, consConf); err != nil {
+			log.Printf("EnableMetrics: could not create metrics client: %v", err)
+		}
+	}
+
 	// start message handling in background
-	connector.consumerChannel = make(chan *flow.FlowMessage, connector.channelLength)
-	go decodeMessages(connector.consumer, connector.consumerChannel)
+	consumerChannelLength := connector.channelLength
+	if connector.batchSize > 0 && uint(connector.batchSize) > consumerChannelLength {
+		// Size the per-message channel to hold at least one full batch.
+		// It stays bounded, so a slow ConsumerBatchChannel reader throttles
+		// Sarama rather than having flows pile up unbounded in memory.
+		consumerChannelLength = uint(connector.batchSize)
+	}
+	connector.consumerChannel = make(chan *flow.FlowMessage, consumerChannelLength)
+	connector.notifications = make(chan *Notification, connector.channelLength)
+	ctx, cancel := context.WithCancel(context.Background())
+	connector.consumerCancel = cancel
+
+	codec := connector.codec
+	if codec == nil {
+		codec = ProtobufCodec{}
+	}
+
+	if connector.parallelDecoders > 1 {
+		connector.decodeJobs = make(chan decodeJob, connector.parallelDecoders)
+		for i := 0; i < connector.parallelDecoders; i++ {
+			go decodeWorker(connector.decodeJobs)
+		}
+	}
+
+	handler := &Consumer{
+		ready:         make(chan bool),
+		flows:         connector.consumerChannel,
+		notifications: connector.notifications,
+		onAssign:      connector.onAssign,
+		onRevoke:      connector.onRevoke,
+		decodeJobs:    connector.decodeJobs,
+		decodeWindow:  connector.parallelDecoders,
+		codec:         codec,
+		metrics:       connector.metrics,
+		cancel:        cancel,
+	}
+	if connector.metrics != nil {
+		handler.offsets = newOffsetTracker()
+		// Capture the client by value now, rather than reading
+		// connector.metricsClient from the poller goroutine later:
+		// closeMetricsClient() closes and nils that field on shutdown
+		// without synchronizing with this detached goroutine.
+		metricsClient := connector.metricsClient
+		handler.startLagPoller = func(ctx context.Context, partitions []TopicPartition) {
+			connector.startLagPoller(ctx, consumergroup, partitions, metricsClient, handler.offsets)
+		}
+	}
+
+	if connector.batchSize > 0 {
+		connector.consumerBatchChannel = make(chan []*flow.FlowMessage, 1)
+		go connector.batchFlows(ctx)
+	}
+	consumeErr := make(chan error, 1)
+	go func() {
+		const (
+			initialBackoff        = time.Second
+			maxBackoff            = 30 * time.Second
+			maxConsecutiveFailure = 5
+		)
+		backoff := initialBackoff
+		failures := 0
+		for {
+			// Consume blocks until a rebalance happens or the context is
+			// cancelled; it must be called again in a loop to recover
+			// after each rebalance, as required by sarama.ConsumerGroup.
+			err := connector.consumerGroup.Consume(ctx, topics, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Kafka Consumer Error: %s\n", err)
+				failures++
+				if failures >= maxConsecutiveFailure {
+					// A session has never been established after several
+					// tries in a row; surface the error to StartConsumer
+					// instead of retrying forever with nothing listening
+					// on handler.ready.
+					select {
+					case consumeErr <- err:
+					default:
+					}
+				}
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				if backoff < maxBackoff {
+					backoff *= 2
+				}
+				handler.ready = make(chan bool)
+				continue
+			}
+			failures = 0
+			backoff = initialBackoff
+			handler.ready = make(chan bool)
+		}
+	}()
+	select {
+	case <-handler.ready:
+	case err := <-consumeErr:
+		cancel()
+		return fmt.Errorf("kafka consumer: giving up after repeated session failures: %w", err)
+	}
+
 	if !connector.manualErrFlag {
 		go func() {
 			log.Println("Spawned a Consumer Logger, no manual error handling.")
 			running := true
 			for running {
 				select {
-				case msg, ok := <-connector.consumer.Errors():
+				case msg, ok := <-connector.consumerGroup.Errors():
 					if !ok {
 						running = false
 						continue
 					}
 					log.Printf("Kafka Consumer Error: %s\n", msg.Error())
-				case msg, ok := <-connector.consumer.Notifications():
+				case msg, ok := <-connector.notifications:
 					if !ok {
 						running = false
 						continue
@@ -130,6 +425,8 @@ func (connector *Connector) StartConsumer(broker string, topics []string, consum
 					log.Printf("Kafka Consumer Notification: %+v\n", msg)
 				case _, ok := <-connector.manualErrSignal:
 					running = ok
+				case <-ctx.Done():
+					running = false
 				}
 			}
 			log.Println("Consumer Logger terminated.")
@@ -149,8 +446,29 @@ func (connector *Connector) StartProducer(broker string, topic string) error {
 	prodConf.Producer.Return.Successes = false // this would block until we've read the ACK
 	prodConf.Producer.Return.Errors = true
 
+	if connector.exactlyOnce {
+		prodConf.Producer.Idempotent = true
+		prodConf.Producer.Transaction.ID = connector.transactionalID
+		prodConf.Producer.RequiredAcks = sarama.WaitForAll
+		prodConf.Net.MaxOpenRequests = 1
+	}
+	if connector.saramaRegistry != nil {
+		prodConf.MetricRegistry = connector.saramaRegistry
+	}
+
+	tlsConfig, err := connector.buildTLSConfig()
+	if err != nil {
+		log.Println("TLS Error:", err)
+		return err
+	}
+	prodConf.Net.TLS.Enable = true
+	prodConf.Net.TLS.Config = tlsConfig
+
+	if err := connector.configureSASL(prodConf); err != nil {
+		return err
+	}
+
 	// everything declared and configured, lets go
-	var err error
 	connector.producer, err = sarama.NewAsyncProducer(brokers, prodConf)
 	if err != nil {
 		return err
@@ -158,7 +476,24 @@ func (connector *Connector) StartProducer(broker string, topic string) error {
 
 	// start message handling in background
 	connector.producerChannel = make(chan *flow.FlowMessage, connector.channelLength)
-	go encodeMessages(connector.producer, topic, connector.producerChannel)
+	encodeInput := connector.producerChannel
+	if connector.metrics != nil {
+		// Tap the channel so every flow is counted before encoding, rather
+		// than instrumenting encodeFlows itself.
+		encodeInput = make(chan *flow.FlowMessage, connector.channelLength)
+		go func() {
+			defer close(encodeInput)
+			for msg := range connector.producerChannel {
+				connector.metrics.flowsProduced.WithLabelValues(topic, "").Inc()
+				encodeInput <- msg
+			}
+		}()
+	}
+	codec := connector.codec
+	if codec == nil {
+		codec = ProtobufCodec{}
+	}
+	go encodeFlows(connector.producer, topic, codec, encodeInput)
 	if !connector.manualErrFlag {
 		go func() {
 			log.Println("Spawned a Producer Logger, no manual error handling.")
@@ -171,6 +506,9 @@ func (connector *Connector) StartProducer(broker string, topic string) error {
 						continue
 					}
 					log.Printf("Kafka Producer Error: %s\n", msg.Error())
+					if connector.metrics != nil {
+						connector.metrics.producerErrors.WithLabelValues(classifyProducerError(msg.Err)).Inc()
+					}
 				case _, ok := <-connector.manualErrSignal:
 					running = ok
 				}
@@ -181,10 +519,28 @@ func (connector *Connector) StartProducer(broker string, topic string) error {
 	return nil
 }
 
+// encodeFlows encodes each flow off input with codec and hands the result to
+// producer as a message on topic, until input is closed. Encode errors are
+// logged and the message is dropped, since there is no broken-message sink
+// to route it to on the producer side.
+func encodeFlows(producer sarama.AsyncProducer, topic string, codec Codec, input chan *flow.FlowMessage) {
+	for msg := range input {
+		data, err := codec.Encode(msg)
+		if err != nil {
+			log.Printf("encodeFlows: Could not encode message: %v", err)
+			continue
+		}
+		producer.Input() <- &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)}
+	}
+}
+
 // Close closes the connection to kafka, i.e. Consumer and Producer
 func (connector *Connector) Close() {
-	if connector.consumer != nil {
-		connector.consumer.Close()
+	if connector.consumerGroup != nil {
+		connector.consumerCancel()
+		connector.consumerGroup.Close()
+		connector.closeMetricsClient()
+		connector.closeDecodeWorkers()
 		log.Println("Kafka Consumer connection closed.")
 	}
 	if connector.producer != nil {
@@ -193,16 +549,41 @@ func (connector *Connector) Close() {
 	}
 }
 
-// Close the Kafka Consumer specifically.
+// Close the Kafka Consumer specifically. This cancels the context driving
+// the consume loop, so a blocked ConsumeClaim send is interrupted instead
+// of leaking.
 func (connector *Connector) CloseConsumer() {
-	if connector.consumer != nil {
-		connector.consumer.Close()
+	if connector.consumerGroup != nil {
+		connector.consumerCancel()
+		connector.consumerGroup.Close()
+		connector.closeMetricsClient()
+		connector.closeDecodeWorkers()
 		log.Println("Kafka Consumer connection closed.")
 	} else {
 		log.Println("WARNING: CloseConsumer called, but no Consumer was initialized.")
 	}
 }
 
+// closeDecodeWorkers shuts down the decodeWorker pool started by
+// StartConsumer for SetParallelDecoders, if any. consumerGroup.Close()
+// above blocks until every ConsumeClaim has returned, so it is safe to
+// close decodeJobs here without racing a pending send.
+func (connector *Connector) closeDecodeWorkers() {
+	if connector.decodeJobs != nil {
+		close(connector.decodeJobs)
+		connector.decodeJobs = nil
+	}
+}
+
+// closeMetricsClient tears down the extra Client opened by StartConsumer
+// for EnableMetrics's lag collection, if any.
+func (connector *Connector) closeMetricsClient() {
+	if connector.metricsClient != nil {
+		connector.metricsClient.Close()
+		connector.metricsClient = nil
+	}
+}
+
 // Close the Kafka Producer specifically.
 func (connector *Connector) CloseProducer() {
 	if connector.producer != nil {
@@ -221,6 +602,58 @@ func (connector *Connector) ConsumerChannel() <-chan *flow.FlowMessage {
 	return connector.consumerChannel
 }
 
+// ConsumerBatchChannel returns the channel delivering batches of up to the
+// size configured via SetConsumerBatch, flushed early after maxWait. It is
+// only populated if SetConsumerBatch was called before StartConsumer.
+func (connector *Connector) ConsumerBatchChannel() <-chan []*flow.FlowMessage {
+	return connector.consumerBatchChannel
+}
+
+// batchFlows groups messages off consumerChannel into batches of up to
+// batchSize, flushing early after batchMaxWait, and delivers them on
+// consumerBatchChannel until ctx is cancelled or consumerChannel closes.
+func (connector *Connector) batchFlows(ctx context.Context) {
+	defer close(connector.consumerBatchChannel)
+	batch := make([]*flow.FlowMessage, 0, connector.batchSize)
+	timer := time.NewTimer(connector.batchMaxWait)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		connector.consumerBatchChannel <- batch
+		batch = make([]*flow.FlowMessage, 0, connector.batchSize)
+	}
+	resetTimer := func() {
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(connector.batchMaxWait)
+	}
+
+	for {
+		select {
+		case msg, ok := <-connector.consumerChannel:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= connector.batchSize {
+				flush()
+				resetTimer()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(connector.batchMaxWait)
+		case <-ctx.Done():
+			flush()
+			return
+		}
+	}
+}
+
 // Return the channel used for handing over Flows to the Kafka Producer.
 // If writing to this channel blocks, check the log.
 func (connector *Connector) ProducerChannel() chan *flow.FlowMessage {
@@ -233,18 +666,20 @@ func (connector *Connector) ProducerChannel() chan *flow.FlowMessage {
 // has been called.
 // IMPORTANT: read EnableManualErrorHandling docs carefully
 func (connector *Connector) ConsumerErrors() <-chan error {
-	return connector.consumer.Errors()
+	return connector.consumerGroup.Errors()
 }
 
-// Consumer Notifications are relayed directly from the Kafka Cluster.
-// These include which topics and partitions are read by this instance
-// and are sent on every Rebalancing Event.
+// Notifications reports consumer group rebalance events: which topics and
+// partitions are read by this instance, sent whenever a rebalance starts or
+// completes. An event is dropped rather than queued if the channel has no
+// free buffer space and no reader waiting when it is sent. See also
+// SetRebalanceCallbacks for a callback-based equivalent.
 //
 // This will become an exclusive reference only after EnableManualErrorHandling
 // has been called.
 // IMPORTANT: read EnableManualErrorHandling docs carefully
-func (connector *Connector) ConsumerNotifications() <-chan *cluster.Notification {
-	return connector.consumer.Notifications()
+func (connector *Connector) Notifications() <-chan *Notification {
+	return connector.notifications
 }
 
 // Producer Errors are relayed directly from the Kafka Cluster.
@@ -255,3 +690,36 @@ func (connector *Connector) ConsumerNotifications() <-chan *cluster.Notification
 func (connector *Connector) ProducerErrors() <-chan *sarama.ProducerError {
 	return connector.producer.Errors()
 }
+
+// BeginTxn starts a new Kafka transaction on the producer. Requires
+// EnableExactlyOnce to have been called before StartProducer.
+func (connector *Connector) BeginTxn() error {
+	return connector.producer.BeginTxn()
+}
+
+// CommitTxn commits the currently open Kafka transaction.
+func (connector *Connector) CommitTxn() error {
+	return connector.producer.CommitTxn()
+}
+
+// AbortTxn aborts the currently open Kafka transaction.
+func (connector *Connector) AbortTxn() error {
+	return connector.producer.AbortTxn()
+}
+
+// SendOffsetsToTxn ties the given consumer offsets for groupID to the
+// currently open transaction, so that once committed, a batch of re-emitted
+// flows on the producer topic is acknowledged atomically with the flows it
+// was derived from. offsets maps each consumed topic to its
+// partition->offset map.
+func (connector *Connector) SendOffsetsToTxn(offsets map[string]map[int32]int64, groupID string) error {
+	perTopic := make(map[string][]*sarama.PartitionOffsetMetadata, len(offsets))
+	for topic, partitions := range offsets {
+		metas := make([]*sarama.PartitionOffsetMetadata, 0, len(partitions))
+		for partition, offset := range partitions {
+			metas = append(metas, &sarama.PartitionOffsetMetadata{Partition: partition, Offset: offset})
+		}
+		perTopic[topic] = metas
+	}
+	return connector.producer.AddOffsetsToTxn(perTopic, groupID)
+}
@@ -2,35 +2,131 @@ package kafka
 
 import (
 	"context"
+	"log"
+	"strconv"
+	"time"
+
 	"github.com/Shopify/sarama"
 	flow "github.com/bwNetFlow/protobuf/go"
-	"github.com/golang/protobuf/proto"
-	"log"
 )
 
+// TopicPartition identifies a single partition of a topic, as reported by
+// SetRebalanceCallbacks and Notifications.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// NotificationType describes the kind of rebalance event carried by a
+// Notification.
+type NotificationType int
+
+const (
+	// RebalanceStart is sent when a rebalance begins, right before this
+	// instance's current partitions are revoked.
+	RebalanceStart NotificationType = iota
+	// RebalanceOK is sent once a rebalance has completed and partitions
+	// have been (re-)assigned to this instance.
+	RebalanceOK
+)
+
+// Notification reports a consumer group rebalance event, as relayed by
+// Connector.Notifications.
+type Notification struct {
+	Type    NotificationType
+	Current []TopicPartition
+}
+
 // Consumer represents a Sarama consumer group consumer
 type Consumer struct {
-	ready  chan bool
-	flows  chan *flow.FlowMessage
-	cancel context.CancelFunc
+	ready          chan bool
+	flows          chan *flow.FlowMessage
+	notifications  chan *Notification
+	onAssign       func([]TopicPartition)
+	onRevoke       func([]TopicPartition)
+	decodeJobs     chan decodeJob
+	decodeWindow   int
+	codec          Codec
+	metrics        *metrics
+	offsets        *offsetTracker
+	startLagPoller func(ctx context.Context, partitions []TopicPartition)
+	cancel         context.CancelFunc
+}
+
+// decodeJob is a unit of work for decodeWorker: decode data with codec and
+// report the result on reply. Used by Connector.SetParallelDecoders to
+// spread decoding across a worker pool shared by all claimed partitions.
+type decodeJob struct {
+	data  []byte
+	codec Codec
+	reply chan decodeResult
+}
+
+type decodeResult struct {
+	msg *flow.FlowMessage
+	err error
+}
+
+// decodeWorker services decode jobs off jobs until it is closed.
+func decodeWorker(jobs chan decodeJob) {
+	for job := range jobs {
+		flowMsg, err := job.codec.Decode(job.data)
+		if err != nil {
+			job.reply <- decodeResult{err: err}
+			continue
+		}
+		job.reply <- decodeResult{msg: flowMsg}
+	}
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	// Create our return channel
-	consumer.flows = make(chan *flow.FlowMessage)
+func (consumer *Consumer) Setup(session sarama.ConsumerGroupSession) error {
+	current := claimsToPartitions(session.Claims())
+	if consumer.onAssign != nil {
+		consumer.onAssign(current)
+	}
+	sendNotification(consumer.notifications, &Notification{Type: RebalanceOK, Current: current})
+	if consumer.metrics != nil {
+		consumer.metrics.rebalances.WithLabelValues("ok").Inc()
+	}
+	if consumer.startLagPoller != nil {
+		go consumer.startLagPoller(session.Context(), current)
+	}
 	// Mark the consumer as ready
 	close(consumer.ready)
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	current := claimsToPartitions(session.Claims())
+	if consumer.onRevoke != nil {
+		consumer.onRevoke(current)
+	}
+	sendNotification(consumer.notifications, &Notification{Type: RebalanceStart, Current: current})
+	if consumer.metrics != nil {
+		consumer.metrics.rebalances.WithLabelValues("start").Inc()
+	}
 	return nil
 }
 
+// sendNotification delivers n on ch without blocking, so a caller that
+// isn't draining Notifications() can't stall Setup/Cleanup (and, via
+// Cleanup, the consumer group's shutdown).
+func sendNotification(ch chan *Notification, n *Notification) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- n:
+	default:
+	}
+}
+
 func (consumer *Consumer) Close() {
-	consumer.cancel()
+	if consumer.cancel != nil {
+		consumer.cancel()
+	}
 }
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
@@ -39,17 +135,123 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	// Do not move the code below to a goroutine.
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
+	if consumer.decodeJobs != nil {
+		return consumer.consumeClaimParallel(session, claim)
+	}
 	for message := range claim.Messages() {
-		// log.Printf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-		session.MarkMessage(message, "")
-		flowMsg := new(flow.FlowMessage)
-		err := proto.Unmarshal(message.Value, flowMsg)
-		if err != nil {
-			log.Printf("decodeMessages: Received broken message: %v", err)
-			continue
+		flowMsg, decodeErr := consumer.codec.Decode(message.Value)
+		if consumer.handleDecoded(session, message, flowMsg, decodeErr) {
+			return nil
 		}
-		consumer.flows <- flowMsg
 	}
-
 	return nil
 }
+
+// consumeClaimParallel mirrors ConsumeClaim's inline loop, but keeps up to
+// decodeWindow messages decoding concurrently on the shared decodeWorker
+// pool instead of submitting one job and blocking on its reply before
+// fetching the next message. Results are drained in the order their
+// messages were claimed, so MarkMessage still advances this partition's
+// offset monotonically.
+func (consumer *Consumer) consumeClaimParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	type pending struct {
+		message *sarama.ConsumerMessage
+		reply   chan decodeResult
+	}
+
+	window := consumer.decodeWindow
+	if window < 1 {
+		window = 1
+	}
+	inFlight := make([]pending, 0, window)
+
+	drainOldest := func() bool {
+		head := inFlight[0]
+		inFlight = inFlight[1:]
+		result := <-head.reply
+		return consumer.handleDecoded(session, head.message, result.msg, result.err)
+	}
+
+	messages := claim.Messages()
+	for {
+		if len(inFlight) >= window {
+			if drainOldest() {
+				return nil
+			}
+		}
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				for len(inFlight) > 0 {
+					if drainOldest() {
+						return nil
+					}
+				}
+				return nil
+			}
+			reply := make(chan decodeResult, 1)
+			consumer.decodeJobs <- decodeJob{data: message.Value, codec: consumer.codec, reply: reply}
+			inFlight = append(inFlight, pending{message: message, reply: reply})
+		case <-session.Context().Done():
+			for len(inFlight) > 0 {
+				if drainOldest() {
+					return nil
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// handleDecoded marks message and, on a successful decode, forwards
+// flowMsg to consumer.flows. It reports whether the session's context was
+// cancelled while waiting to forward, in which case ConsumeClaim should
+// stop without marking this message so it is redelivered to whichever
+// consumer picks up the partition next.
+func (consumer *Consumer) handleDecoded(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, flowMsg *flow.FlowMessage, decodeErr error) bool {
+	if decodeErr != nil {
+		log.Printf("handleDecoded: Received broken message: %v", decodeErr)
+		if consumer.metrics != nil {
+			consumer.metrics.decodeErrors.Inc()
+		}
+		session.MarkMessage(message, "")
+		consumer.markOffset(message)
+		return false
+	}
+	if consumer.metrics != nil {
+		partition := strconv.Itoa(int(message.Partition))
+		consumer.metrics.flowsConsumed.WithLabelValues(message.Topic, partition).Inc()
+		consumer.metrics.decodeLatency.Observe(time.Since(message.Timestamp).Seconds())
+	}
+	select {
+	case consumer.flows <- flowMsg:
+		session.MarkMessage(message, "")
+		consumer.markOffset(message)
+		return false
+	case <-session.Context().Done():
+		return true
+	}
+}
+
+// markOffset records message's offset in consumer.offsets, so startLagPoller
+// can compute lag from this process's own consumption progress instead of
+// querying a second OffsetManager for the same group.
+func (consumer *Consumer) markOffset(message *sarama.ConsumerMessage) {
+	if consumer.offsets == nil {
+		return
+	}
+	tp := TopicPartition{Topic: message.Topic, Partition: message.Partition}
+	consumer.offsets.mark(tp, message.Offset)
+}
+
+// claimsToPartitions flattens a ConsumerGroupSession's Claims() into a
+// TopicPartition slice, for use in rebalance callbacks and Notifications.
+func claimsToPartitions(claims map[string][]int32) []TopicPartition {
+	var partitions []TopicPartition
+	for topic, ps := range claims {
+		for _, p := range ps {
+			partitions = append(partitions, TopicPartition{Topic: topic, Partition: p})
+		}
+	}
+	return partitions
+}
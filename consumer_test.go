@@ -0,0 +1,41 @@
+package kafka
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestClaimsToPartitions(t *testing.T) {
+	claims := map[string][]int32{
+		"flows-a": {0, 2},
+		"flows-b": {1},
+	}
+
+	got := claimsToPartitions(claims)
+	if len(got) != 3 {
+		t.Fatalf("len(got) = %d, want 3", len(got))
+	}
+
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].Topic != got[j].Topic {
+			return got[i].Topic < got[j].Topic
+		}
+		return got[i].Partition < got[j].Partition
+	})
+	want := []TopicPartition{
+		{Topic: "flows-a", Partition: 0},
+		{Topic: "flows-a", Partition: 2},
+		{Topic: "flows-b", Partition: 1},
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestClaimsToPartitionsEmpty(t *testing.T) {
+	if got := claimsToPartitions(nil); got != nil {
+		t.Fatalf("claimsToPartitions(nil) = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	prometheusmetrics "github.com/deathowl/go-metrics-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// defaultLagPollInterval is how often startLagPoller refreshes
+// kafka_consumer_lag while metrics are enabled.
+const defaultLagPollInterval = 30 * time.Second
+
+// metrics holds the Prometheus collectors registered by EnableMetrics.
+type metrics struct {
+	flowsConsumed  *prometheus.CounterVec
+	flowsProduced  *prometheus.CounterVec
+	decodeErrors   prometheus.Counter
+	decodeLatency  prometheus.Histogram
+	rebalances     *prometheus.CounterVec
+	producerErrors *prometheus.CounterVec
+	consumerLag    *prometheus.GaugeVec
+}
+
+// EnableMetrics bridges Sarama's internal go-metrics registry into registry
+// via go-metrics-prometheus, and registers first-class collectors under
+// namespace for flow throughput, decode errors/latency, rebalance events,
+// producer errors by error class, and consumer lag (refreshed periodically
+// from the broker's high water marks). Call this before
+// StartConsumer/StartProducer so the Sarama config picks up the bridged
+// metrics registry.
+func (connector *Connector) EnableMetrics(registry prometheus.Registerer, namespace string) error {
+	m := &metrics{
+		flowsConsumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flows_consumed_total",
+			Help:      "Number of flows consumed, by topic and partition.",
+		}, []string{"topic", "partition"}),
+		flowsProduced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flows_produced_total",
+			Help:      "Number of flows handed to the producer, by topic and partition. Partition is always empty, since the producer does not return per-message successes.",
+		}, []string{"topic", "partition"}),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decode_errors_total",
+			Help:      "Number of consumed messages the configured codec failed to decode.",
+		}),
+		decodeLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "decode_latency_seconds",
+			Help:      "Time between a message's Kafka timestamp and its successful decode.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		rebalances: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rebalances_total",
+			Help:      "Number of consumer group rebalance events, by type (start, ok).",
+		}, []string{"type"}),
+		producerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "producer_errors_total",
+			Help:      "Number of producer errors, by error class.",
+		}, []string{"class"}),
+		consumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "consumer_lag",
+			Help:      "Difference between a partition's high water mark and the offset after this consumer's last marked message.",
+		}, []string{"topic", "partition", "group"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.flowsConsumed, m.flowsProduced, m.decodeErrors, m.decodeLatency,
+		m.rebalances, m.producerErrors, m.consumerLag,
+	} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	connector.metrics = m
+	connector.metricsLagInterval = defaultLagPollInterval
+	connector.saramaRegistry = gometrics.NewRegistry()
+	provider := prometheusmetrics.NewPrometheusProvider(connector.saramaRegistry, namespace, "sarama", registry, time.Second)
+	go provider.UpdatePrometheusMetrics()
+	return nil
+}
+
+// classifyProducerError turns a producer error into a short label suitable
+// for the producer_errors_total class label, without unbounded cardinality.
+func classifyProducerError(err error) string {
+	if kerr, ok := err.(sarama.KError); ok {
+		return kerr.Error()
+	}
+	return "other"
+}
+
+// offsetTracker records the most recently marked offset per partition for a
+// running Consumer, so startLagPoller can compute lag from this process's
+// own consumption progress instead of opening a second OffsetManager for a
+// group the live consumer group already manages.
+type offsetTracker struct {
+	mu      sync.Mutex
+	offsets map[TopicPartition]int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{offsets: make(map[TopicPartition]int64)}
+}
+
+func (t *offsetTracker) mark(tp TopicPartition, offset int64) {
+	t.mu.Lock()
+	t.offsets[tp] = offset
+	t.mu.Unlock()
+}
+
+func (t *offsetTracker) get(tp TopicPartition) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	offset, ok := t.offsets[tp]
+	return offset, ok
+}
+
+// startLagPoller periodically compares the broker's high water mark (read
+// via client) against this Consumer's own last-marked offset (via offsets)
+// for each of partitions, and publishes the result via the consumer_lag
+// gauge. It runs until ctx is cancelled, i.e. until the session ends at the
+// next rebalance. client is passed in rather than read from
+// connector.metricsClient on every tick, since closeMetricsClient closes
+// and nils that field from Close/CloseConsumer without synchronizing with
+// this detached goroutine. A partition is skipped until offsets has seen at
+// least one message for it, since there is no committed offset to compare
+// against during that warm-up window.
+func (connector *Connector) startLagPoller(ctx context.Context, group string, partitions []TopicPartition, client sarama.Client, offsets *offsetTracker) {
+	if connector.metrics == nil || client == nil {
+		return
+	}
+
+	ticker := time.NewTicker(connector.metricsLagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, tp := range partitions {
+				nextOffset, ok := offsets.get(tp)
+				if !ok {
+					continue
+				}
+				highWaterMark, err := client.GetOffset(tp.Topic, tp.Partition, sarama.OffsetNewest)
+				if err != nil {
+					continue
+				}
+				lag := highWaterMark - (nextOffset + 1)
+				if lag < 0 {
+					lag = 0
+				}
+				partition := strconv.Itoa(int(tp.Partition))
+				connector.metrics.consumerLag.WithLabelValues(tp.Topic, partition, group).Set(float64(lag))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
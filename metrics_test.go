@@ -0,0 +1,26 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestClassifyProducerError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"KError", sarama.ErrNotLeaderForPartition, sarama.ErrNotLeaderForPartition.Error()},
+		{"other", errors.New("boom"), "other"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyProducerError(c.err); got != c.want {
+				t.Fatalf("classifyProducerError(%v) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"github.com/xdg-go/scram"
+)
+
+// SHA256 and SHA512 are the hash generators configureSASL uses when SetSASL
+// selects sarama.SASLTypeSCRAMSHA256/SASLTypeSCRAMSHA512 respectively.
+var (
+	SHA256 scram.HashGeneratorFcn = sha256.New
+	SHA512 scram.HashGeneratorFcn = sha512.New
+)
+
+// XDGSCRAMClient adapts github.com/xdg-go/scram to sarama.SCRAMClient, as
+// recommended by Sarama's own SASL/SCRAM documentation.
+type XDGSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// Begin implements sarama.SCRAMClient.
+func (c *XDGSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+// Step implements sarama.SCRAMClient.
+func (c *XDGSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+// Done implements sarama.SCRAMClient.
+func (c *XDGSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
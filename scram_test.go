@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXDGSCRAMClientBeginAndStep(t *testing.T) {
+	client := &XDGSCRAMClient{HashGeneratorFcn: SHA256}
+
+	if err := client.Begin("user", "pencil", ""); err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if client.Done() {
+		t.Fatal("Done() = true before any Step")
+	}
+
+	first, err := client.Step("")
+	if err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	if !strings.HasPrefix(first, "n,,n=user,r=") {
+		t.Fatalf("client-first-message = %q, want prefix %q", first, "n,,n=user,r=")
+	}
+}